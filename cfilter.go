@@ -10,36 +10,47 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/legionus/getopt"
 )
 
 var (
-	prog       = ""
-	version    = "1.0"
-	bufferSize = 4096
+	prog              = ""
+	version           = "1.0"
+	bufferSize        = 4096
+	defaultScrollback = 20000
 )
 
 type Group struct {
 	Name     string
 	Number   int
 	Colorize Colorize
+	// IsKey marks a group tagged "key" in a pattern's rule line (e.g.
+	// `/LogId\[(?P<id>\d+)\]/ id:key`) instead of a colorize spec. Lines
+	// matching it are buffered by the group's value instead of colorized,
+	// see GroupBuffer.
+	IsKey bool
 }
 
 type Pattern struct {
 	RE     *regexp.Regexp
 	Groups []Group
+	// Trigger marks a pattern tagged "trigger" (e.g. `/ERROR/ trigger`):
+	// when it matches a line that belongs to a buffered key, the whole
+	// buffered group is flushed. See GroupBuffer.
+	Trigger bool
 }
 
 type LinePositionKind int
@@ -71,19 +82,47 @@ Usage: %[1]s [options] [FILE...]
 This utility is a simple filter, you can use to colorize output of any program.
 
 Options:
-  --bufsile=SIZE         buffer size which used to read line (default: %d);
+  --bufsize=SIZE         buffer size which used to read line (default: %[2]d);
   -c, --command          run COMMAND and filter output;
   -1, --stdout           filter stdout of COMMAND;
   -2, --stderr           filter stderr of COMMAND;
   -e, --regexp=PATTERN   use PATTERN for matching;
-  -f, --file=FILE        obtain PATTERN from FILE;
+  -f, --file=FILE        obtain PATTERN from FILE (supports "palette NAME { }",
+                         "include PATH" and "@when tty|pipe|env(VAR=val)");
+  --format=FORMAT        output format: ansi, ansi256, truecolor, html or
+                         json (default: ansi);
+  --css-class=NAME       with --format=html, emit "NAME-GROUP" classes
+                         instead of inline styles;
+  --group-max-lines=N    smart context: drop a key's oldest buffered lines
+                         past N (tag a group "key" and a pattern "trigger"
+                         to enable, e.g. id:key and /ERROR/ trigger);
+  --group-max-bytes=N    smart context: drop a key's oldest buffered lines
+                         past N bytes;
+  --group-max-age=DUR    smart context: drop a key's buffered lines older
+                         than DUR (e.g. 30s, 5m);
+  --group-max-keys=N     smart context: forget the least-recently-seen key
+                         past N distinct keys, so a long-running --follow
+                         keying on something unbounded (e.g. a request ID)
+                         doesn't grow memory forever;
+  --workers=N            match lines on a pool of N goroutines instead of
+                         one (default: 0, sequential);
+  -F, --follow           keep reading FILE as it grows, like tail -F,
+                         instead of stopping at the end;
+  --follow-name          like --follow, and also reopen FILE across
+                         rotation (a new file at the same path) or
+                         in-place truncation;
+  --interactive          browse the colorized output full-screen instead of
+                         printing it, with scrollback, incremental search
+                         and per-rule toggles ("%[1]s view ..." also works);
+  --scrollback=N         lines of scrollback --interactive keeps (default:
+                         %[3]d);
   -V, --version          print program version and exit;
   -h, --help             show this text and exit.
 
 Report bugs to author.
 
 `,
-		prog, bufferSize)
+		prog, bufferSize, defaultScrollback)
 	os.Exit(0)
 	return nil
 }
@@ -112,7 +151,7 @@ func fatal(format string, v ...interface{}) {
 	os.Exit(1)
 }
 
-func parsePattern(filename string, num int, line string) (Pattern, error) {
+func parsePattern(filename string, num int, line string, palettes Palette) (Pattern, error) {
 	line = strings.TrimSpace(line)
 
 	if len(line) == 0 {
@@ -139,16 +178,44 @@ func parsePattern(filename string, num int, line string) (Pattern, error) {
 	}
 
 	names := map[string]Colorize{}
+	keyGroups := map[string]bool{}
 
+	col := last + 1
 	for i, s := range strings.Split(line[last+1:], ",") {
+		fieldCol := col + 1
+		col += len(s) + 1
+
+		s = strings.TrimSpace(s)
 		if len(s) == 0 {
 			continue
 		}
+		if s == "trigger" {
+			pattern.Trigger = true
+			continue
+		}
 		pair := strings.Split(s, ":")
 		if len(pair) != 2 {
-			return Pattern{}, fmt.Errorf("%s:%d: bad format: can not parse group %d", filename, num, i)
+			return Pattern{}, fmt.Errorf("%s:%d:%d: bad format: can not parse group %d", filename, num, fieldCol, i)
+		}
+		name := strings.TrimSpace(pair[0])
+		value := strings.TrimSpace(pair[1])
+		if strings.ToLower(value) == "key" {
+			keyGroups[name] = true
+			continue
+		}
+		if use, ok := parseUsePalette(value); ok {
+			data, ok := palettes[use]
+			if !ok {
+				return Pattern{}, fmt.Errorf("%s:%d:%d: bad format: unknown palette %q", filename, num, fieldCol, use)
+			}
+			names[name] = data
+			continue
+		}
+		data, err := ParseColorize(value)
+		if err != nil {
+			return Pattern{}, fmt.Errorf("%s:%d:%d: %v", filename, num, fieldCol, err)
 		}
-		names[strings.TrimSpace(pair[0])] = ParseColorize(pair[1])
+		names[name] = data
 	}
 
 	for i, name := range pattern.RE.SubexpNames() {
@@ -156,6 +223,15 @@ func parsePattern(filename string, num int, line string) (Pattern, error) {
 			continue
 		}
 
+		if keyGroups[name] {
+			pattern.Groups = append(pattern.Groups, Group{
+				Name:   name,
+				Number: i,
+				IsKey:  true,
+			})
+			continue
+		}
+
 		data, ok := names[name]
 		if !ok {
 			continue
@@ -171,50 +247,57 @@ func parsePattern(filename string, num int, line string) (Pattern, error) {
 	return pattern, nil
 }
 
-func readPatternsFromFile(filename string, rd io.Reader) ([]Pattern, error) {
-	var (
-		line      string
-		readerErr error
-		patterns  []Pattern
-	)
-	lineNum := 0
-	reader := bufio.NewReader(rd)
-
-	for readerErr == nil {
-		lineNum++
-		line, readerErr = reader.ReadString('\n')
-
-		if readerErr != nil && readerErr != io.EOF {
-			return patterns, readerErr
+// hasKeyGroups reports whether any pattern tags a group "key", i.e. whether
+// smart context grouping should be enabled at all.
+func hasKeyGroups(patterns []Pattern) bool {
+	for _, pattern := range patterns {
+		for _, group := range pattern.Groups {
+			if group.IsKey {
+				return true
+			}
 		}
+	}
+	return false
+}
 
-		line = strings.TrimSpace(line)
-
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			continue
-		}
+// processFile reads lines from rd, matches them against patterns and writes
+// the rendered result to wr. When group is non-nil, rendered lines are
+// routed through its key buffering instead of being written directly; see
+// GroupBuffer. combined, when non-nil, prefilters patterns per line; see
+// CombinedMatcher. workers > 1 matches lines on a pool of goroutines, fed
+// from and reassembled into the original order around that prefilter and
+// the (necessarily sequential) rendering step; see matchLinesConcurrently.
+// When records is non-nil, every line read, matched or not, is also sent
+// there, annotated with its spans and per-pattern hits, for a consumer such as the
+// --interactive viewer to browse independently of wr; processFile closes
+// records once rd is exhausted.
+func processFile(patterns []Pattern, rd io.Reader, wr io.Writer, renderer Renderer, group *GroupBuffer, combined *CombinedMatcher, workers int, records chan<- lineMatch) error {
+	if records != nil {
+		defer close(records)
+	}
 
-		pattern, err := parsePattern(filename, lineNum, line)
-		if err != nil {
-			return patterns, err
+	emit := func(m lineMatch) error {
+		if records != nil {
+			records <- lineMatch{
+				line:        append([]byte(nil), m.line...),
+				lineMatches: m.lineMatches,
+				spans:       m.spans,
+				hits:        m.hits,
+			}
 		}
-
-		patterns = append(patterns, pattern)
+		return renderMatch(m, wr, renderer, group)
 	}
 
-	return patterns, nil
-}
+	if workers > 1 {
+		return matchLinesConcurrently(patterns, combined, rd, workers, emit)
+	}
 
-func processFile(patterns []Pattern, rd io.Reader, wr io.Writer) error {
 	var (
 		line      []byte
 		readerErr error
 	)
 	reader := bufio.NewReaderSize(rd, bufferSize)
-
-	lineColorFG := make([]int, len(patterns))
-	lineColorBG := make([]int, len(patterns))
-	lineProperties := make(map[string]int, len(AnsiProperties))
+	seq := 0
 
 	for readerErr == nil {
 		line, readerErr = reader.ReadSlice('\n')
@@ -227,106 +310,37 @@ func processFile(patterns []Pattern, rd io.Reader, wr io.Writer) error {
 			return readerErr
 		}
 
-		var (
-			lineMatches bool
-			positions   LinePositions
-		)
-
-		for n, pattern := range patterns {
-			res := pattern.RE.FindAllSubmatchIndex(line, -1)
-			if res == nil {
-				continue
-			}
-			lineMatches = true
-			for i, group := range pattern.Groups {
-				for _, match := range res {
-					pos := group.Number * 2
-					if match[pos] == match[pos+1] {
-						continue
-					}
-					positions = append(positions,
-						&LinePosition{
-							Kind:     LinePositionStartKind,
-							Order:    n,
-							Offset:   match[pos],
-							Colorize: pattern.Groups[i].Colorize,
-						},
-						&LinePosition{
-							Kind:     LinePositionEndKind,
-							Order:    n,
-							Offset:   match[pos+1],
-							Colorize: pattern.Groups[i].Colorize,
-						})
-				}
-			}
+		if err := emit(matchLine(patterns, combined, seq, line)); err != nil {
+			return err
 		}
+		seq++
+	}
 
-		if len(positions) > 0 {
-			sort.Sort(positions)
-
-			lineOffset := 0
-			prevEscape := ""
-
-			for _, pos := range positions {
-				if lineOffset < pos.Offset {
-					wr.Write(line[lineOffset:pos.Offset])
-					lineOffset = pos.Offset
-				}
-				if lineOffset == pos.Offset {
-					switch pos.Kind {
-					case LinePositionStartKind:
-						for k := range AnsiProperties {
-							if _, ok := pos.Colorize[k]; ok {
-								lineProperties[k]++
-							}
-						}
-						lineColorFG[pos.Order] = pos.Colorize[ForegroundColor]
-						lineColorBG[pos.Order] = pos.Colorize[BackgroundColor]
-					case LinePositionEndKind:
-						for k := range AnsiProperties {
-							if _, ok := pos.Colorize[k]; ok {
-								lineProperties[k]--
-							}
-						}
-						lineColorFG[pos.Order] = 0
-						lineColorBG[pos.Order] = 0
-					}
-
-					var foundFG, foundBG int
-
-					for n := len(patterns) - 1; n >= 0 && (foundFG == 0 || foundBG == 0); n-- {
-						if foundFG == 0 && lineColorFG[n] > 0 {
-							foundFG = lineColorFG[n]
-						}
-						if foundBG == 0 && lineColorBG[n] > 0 {
-							foundBG = lineColorBG[n]
-						}
-					}
-					if foundFG == 0 {
-						foundFG = ResetForeground
-					}
-					if foundBG == 0 {
-						foundBG = ResetBackground
-					}
-					props := ""
-					for k, v := range lineProperties {
-						props += fmt.Sprintf("%d;", Property(k, v > 0))
-					}
+	return nil
+}
 
-					escape := fmt.Sprintf("%s%s%d;%dm", AnsiStart, props, foundFG, foundBG)
+// renderMatch renders one matched line and writes it to wr, routing it
+// through group's key buffering first when group is non-nil.
+func renderMatch(m lineMatch, wr io.Writer, renderer Renderer, group *GroupBuffer) error {
+	var rendered bytes.Buffer
+	if err := renderer.RenderLine(&rendered, m.line, m.spans, m.lineMatches); err != nil {
+		return err
+	}
 
-					if prevEscape != escape {
-						wr.Write([]byte(escape))
-						prevEscape = escape
-					}
-				}
+	if group == nil || rendered.Len() == 0 || len(m.key) == 0 {
+		if rendered.Len() > 0 {
+			if _, err := wr.Write(rendered.Bytes()); err != nil {
+				return err
 			}
-			wr.Write(line[lineOffset:])
-		} else if lineMatches {
-			wr.Write(line)
 		}
+		return nil
 	}
 
+	for _, out := range group.Observe(m.key, rendered.Bytes(), m.triggered) {
+		if _, err := wr.Write(out); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -339,6 +353,25 @@ type CommandFilter struct {
 	Patterns []Pattern
 	Stdout   bool
 	Stderr   bool
+	Format   OutputFormat
+	CSSClass string
+	// Group, when non-nil, is shared between the stdout and stderr
+	// goroutines so a request logged to both streams still groups
+	// together under one key.
+	Group    *GroupBuffer
+	Combined *CombinedMatcher
+	Workers  int
+}
+
+// newRenderer builds a fresh Renderer for one stream. Stdout and stderr are
+// processed by separate goroutines, and the ansi family keeps per-pattern
+// state across a stream, so each stream needs its own instance.
+func (filter *CommandFilter) newRenderer() Renderer {
+	renderer, err := NewRenderer(filter.Format, len(filter.Patterns), filter.CSSClass)
+	if err != nil {
+		fatal("%v", err)
+	}
+	return renderer
 }
 
 func processCommand(filter *CommandFilter, name string, args ...string) {
@@ -354,7 +387,7 @@ func processCommand(filter *CommandFilter, name string, args ...string) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := processFile(filter.Patterns, stdout, os.Stdout)
+			err := processFile(filter.Patterns, stdout, os.Stdout, filter.newRenderer(), filter.Group, filter.Combined, filter.Workers, nil)
 			syncStdStreams()
 			if err != nil {
 				fatal("%v\n", err)
@@ -373,7 +406,7 @@ func processCommand(filter *CommandFilter, name string, args ...string) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := processFile(filter.Patterns, stderr, os.Stderr)
+			err := processFile(filter.Patterns, stderr, os.Stderr, filter.newRenderer(), filter.Group, filter.Combined, filter.Workers, nil)
 			syncStdStreams()
 			if err != nil {
 				fatal("%v\n", err)
@@ -411,6 +444,17 @@ func main() {
 		cmdFilter    bool
 		regexps      []string
 		patternsFile string
+		format       = string(FormatAnsi)
+		cssClass     string
+		groupLines   int
+		groupBytes   int
+		groupAge     string
+		groupKeys    int
+		workers      int
+		follow       bool
+		followName   bool
+		interactive  bool
+		scrollback   = defaultScrollback
 	)
 	opts := &getopt.Getopt{
 		AllowAbbrev: true,
@@ -463,16 +507,92 @@ func main() {
 					return nil
 				},
 			},
+			{getopt.NoShortName, "format", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					format = v
+					return nil
+				},
+			},
+			{getopt.NoShortName, "css-class", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					cssClass = v
+					return nil
+				},
+			},
+			{getopt.NoShortName, "group-max-lines", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) (err error) {
+					groupLines, err = strconv.Atoi(v)
+					return
+				},
+			},
+			{getopt.NoShortName, "group-max-bytes", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) (err error) {
+					groupBytes, err = strconv.Atoi(v)
+					return
+				},
+			},
+			{getopt.NoShortName, "group-max-age", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					groupAge = v
+					return nil
+				},
+			},
+			{getopt.NoShortName, "group-max-keys", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) (err error) {
+					groupKeys, err = strconv.Atoi(v)
+					return
+				},
+			},
+			{getopt.NoShortName, "workers", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) (err error) {
+					workers, err = strconv.Atoi(v)
+					return
+				},
+			},
+			{'F', "follow", getopt.NoArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					follow = true
+					return nil
+				},
+			},
+			{getopt.NoShortName, "follow-name", getopt.NoArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					follow = true
+					followName = true
+					return nil
+				},
+			},
+			{getopt.NoShortName, "interactive", getopt.NoArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) error {
+					interactive = true
+					return nil
+				},
+			},
+			{getopt.NoShortName, "scrollback", getopt.RequiredArgument,
+				func(o *getopt.Option, t getopt.NameType, v string) (err error) {
+					scrollback, err = strconv.Atoi(v)
+					return
+				},
+			},
 		},
 	}
 
 	prog = filepath.Base(os.Args[0])
-	if err := opts.Parse(os.Args); err != nil {
+
+	// "cfilter view ..." is shorthand for "cfilter --interactive ...".
+	parseArgs := os.Args
+	if len(parseArgs) > 1 && parseArgs[1] == "view" {
+		interactive = true
+		parseArgs = append([]string{parseArgs[0]}, parseArgs[2:]...)
+	}
+
+	if err := opts.Parse(parseArgs); err != nil {
 		fatal("%v", err)
 	}
 	args := opts.Args()
 
 	patterns := []Pattern{}
+	palettes := Palette{}
 
 	if len(patternsFile) > 0 {
 		fd, err := os.Open(patternsFile)
@@ -481,7 +601,7 @@ func main() {
 		}
 		defer fd.Close()
 
-		patterns, err = readPatternsFromFile(patternsFile, fd)
+		patterns, palettes, err = readPatternsFromFile(patternsFile, fd)
 		if err != nil {
 			fatal("%v", err)
 		}
@@ -489,7 +609,7 @@ func main() {
 	}
 
 	for i, s := range regexps {
-		pattern, err := parsePattern("Arg", i+1, s)
+		pattern, err := parsePattern("Arg", i+1, s, palettes)
 		if err != nil {
 			fatal("%v", err)
 		}
@@ -500,11 +620,45 @@ func main() {
 		fatal("patterns required")
 	}
 
+	var group *GroupBuffer
+	if hasKeyGroups(patterns) {
+		retention := GroupRetention{MaxLines: groupLines, MaxBytes: groupBytes, MaxKeys: groupKeys}
+		if len(groupAge) > 0 {
+			age, err := time.ParseDuration(groupAge)
+			if err != nil {
+				fatal("%v", err)
+			}
+			retention.MaxAge = age
+		}
+		group = NewGroupBuffer(retention)
+	}
+
+	// The combined-matcher prefilter is approximate (see CombinedMatcher's
+	// doc comment): it can miss a pattern whose match starts at the same
+	// offset as an earlier pattern's. That's an acceptable trade for
+	// --workers, where it's the only way to avoid len(patterns) regexp
+	// passes per line across goroutines, but plain/sequential usage has no
+	// need to trade away exactness, so only build it when workers are
+	// actually in play.
+	var combined *CombinedMatcher
+	if workers > 1 {
+		var err error
+		combined, err = NewCombinedMatcher(patterns)
+		if err != nil {
+			fatal("%v", err)
+		}
+	}
+
 	if cmdFilter {
 		filter := &CommandFilter{
 			Patterns: patterns,
 			Stdout:   cmdStdout,
 			Stderr:   cmdStderr,
+			Format:   OutputFormat(format),
+			CSSClass: cssClass,
+			Group:    group,
+			Combined: combined,
+			Workers:  workers,
 		}
 		if len(args) > 1 {
 			processCommand(filter, args[0], args[1:]...)
@@ -518,8 +672,74 @@ func main() {
 		fatal("option --stderr implies the --command")
 	}
 
+	renderer, err := NewRenderer(OutputFormat(format), len(patterns), cssClass)
+	if err != nil {
+		fatal("%v", err)
+	}
+
+	if interactive {
+		if follow {
+			fatal("--interactive cannot be combined with --follow")
+		}
+
+		var input io.Reader = os.Stdin
+		if len(args) > 0 {
+			readers := make([]io.Reader, 0, len(args))
+			for _, filename := range args {
+				fd, err := os.Open(filename)
+				if err != nil {
+					fatal("%s: %v", filename, err)
+				}
+				defer fd.Close()
+				readers = append(readers, fd)
+			}
+			input = io.MultiReader(readers...)
+		}
+
+		records := make(chan lineMatch, 64)
+		go func() {
+			if err := processFile(patterns, input, io.Discard, renderer, group, combined, workers, records); err != nil {
+				fatal("%v", err)
+			}
+		}()
+
+		if err := runInteractive(patterns, records, scrollback); err != nil {
+			fatal("%v", err)
+		}
+		return
+	}
+
+	if follow {
+		if len(args) == 0 {
+			fatal("--follow requires at least one FILE")
+		}
+
+		var wg sync.WaitGroup
+		for _, filename := range args {
+			fd, err := os.Open(filename)
+			if err != nil {
+				fatal("%s: %v", filename, err)
+			}
+
+			wg.Add(1)
+			go func(filename string, fd *os.File) {
+				defer wg.Done()
+				renderer, err := NewRenderer(OutputFormat(format), len(patterns), cssClass)
+				if err != nil {
+					fatal("%v", err)
+				}
+				reader := newFollowReader(fd, filename, followName)
+				if err := processFile(patterns, reader, os.Stdout, renderer, group, combined, workers, nil); err != nil {
+					fatal("%s: %v", filename, err)
+				}
+			}(filename, fd)
+		}
+		wg.Wait()
+		return
+	}
+
 	if len(args) == 0 {
-		if err := processFile(patterns, os.Stdin, os.Stdout); err != nil {
+		if err := processFile(patterns, os.Stdin, os.Stdout, renderer, group, combined, workers, nil); err != nil {
 			fatal("%v", err)
 		}
 	}
@@ -531,7 +751,7 @@ func main() {
 		}
 		defer fd.Close()
 
-		if err := processFile(patterns, fd, os.Stdout); err != nil {
+		if err := processFile(patterns, fd, os.Stdout, renderer, group, combined, workers, nil); err != nil {
 			fatal("%v", err)
 		}
 		fd.Close()
@@ -9,7 +9,9 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -33,6 +35,14 @@ const (
 	BlinkProperty     = "blink"
 	UnderlineProperty = "underline"
 	InverseProperty   = "inverse"
+
+	// ansi256Offset and truecolorOffset let Colorize keep storing a plain
+	// int per color while still telling apart the three color spaces a
+	// value can come from: a raw value is a basic SGR code (30-107), a
+	// value >= ansi256Offset is an xterm-256 index (color(N)), and a
+	// value >= truecolorOffset packs a 24-bit #rrggbb triplet.
+	ansi256Offset   = 1 << 16
+	truecolorOffset = 1 << 24
 )
 
 const (
@@ -66,7 +76,12 @@ var AnsiProperties = map[string]int{
 
 type Colorize map[string]int
 
-func ParseColorize(spec string) Colorize {
+// ParseColorize parses a space-separated colorize spec, e.g.
+// "bg blue bright bold" or "#336699 underline". It returns an error instead
+// of panicking so callers building a rule file can report it as a
+// diagnostic against the line and column it came from, rather than crashing
+// the whole process over one bad rule.
+func ParseColorize(spec string) (Colorize, error) {
 	c := make(Colorize)
 	colorAddon := 0
 	colorType := "foreground"
@@ -93,12 +108,185 @@ func ParseColorize(spec string) Colorize {
 				c[word] = v
 				continue
 			}
+			if strings.HasPrefix(word, "#") {
+				v, err := parseHexColor(word)
+				if err != nil {
+					return nil, err
+				}
+				c[colorType] = v
+				continue
+			}
+			if strings.HasPrefix(word, "color(") && strings.HasSuffix(word, ")") {
+				v, err := parse256Color(word)
+				if err != nil {
+					return nil, err
+				}
+				c[colorType] = v
+				continue
+			}
 			if len(word) > 0 {
-				panic("unknown keyword: " + word)
+				return nil, fmt.Errorf("unknown keyword: %q", word)
+			}
+		}
+	}
+	return c, nil
+}
+
+// parseHexColor parses a "#rrggbb" token into a Colorize value carrying a
+// 24-bit truecolor triplet, distinguishable from a basic SGR code by
+// truecolorOffset.
+func parseHexColor(word string) (int, error) {
+	hex := word[1:]
+	if len(hex) != 6 {
+		return 0, fmt.Errorf("invalid color: %q: expected #rrggbb", word)
+	}
+	v, err := strconv.ParseInt(hex, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid color: %q: %v", word, err)
+	}
+	return truecolorOffset + int(v), nil
+}
+
+// parse256Color parses a "color(N)" token into a Colorize value carrying an
+// xterm-256 palette index, distinguishable from a basic SGR code by
+// ansi256Offset.
+func parse256Color(word string) (int, error) {
+	num := word[len("color(") : len(word)-1]
+	v, err := strconv.Atoi(num)
+	if err != nil {
+		return 0, fmt.Errorf("invalid color: %q: %v", word, err)
+	}
+	if v < 0 || v > 255 {
+		return 0, fmt.Errorf("invalid color: %q: out of range 0-255", word)
+	}
+	return ansi256Offset + v, nil
+}
+
+// clampColorValue downconverts value (which may carry a truecolor or
+// xterm-256 encoding, see truecolorOffset/ansi256Offset) to whatever format
+// can actually display, so --format=ansi256 and --format=ansi don't emit
+// escapes a 256-color or basic-16 terminal can't render; --format=truecolor
+// is a no-op since it can show everything. background distinguishes a
+// background color from a foreground one, since the basic-16 encoding bakes
+// the backgroundColor/brightColor offsets into the returned value itself
+// (see ParseColorize).
+func clampColorValue(value int, format OutputFormat, background bool) int {
+	switch format {
+	case FormatTruecolor:
+		return value
+	case FormatAnsi256:
+		if value < truecolorOffset {
+			return value
+		}
+		rgb := value - truecolorOffset
+		return ansi256Offset + rgbToAnsi256((rgb>>16)&0xff, (rgb>>8)&0xff, rgb&0xff)
+	default: // FormatAnsi: basic 16-color
+		switch {
+		case value >= truecolorOffset:
+			rgb := value - truecolorOffset
+			return rgbToBasic16((rgb>>16)&0xff, (rgb>>8)&0xff, rgb&0xff, background)
+		case value >= ansi256Offset:
+			r, g, b := ansi256ToRGB(value - ansi256Offset)
+			return rgbToBasic16(r, g, b, background)
+		default:
+			return value
+		}
+	}
+}
+
+// rgbToAnsi256 maps a 24-bit color onto the xterm-256 palette: the 6x6x6
+// color cube for chromatic colors, and the grayscale ramp for colors whose
+// channels are all equal.
+func rgbToAnsi256(r, g, b int) int {
+	if r == g && g == b {
+		switch {
+		case r < 8:
+			return 16
+		case r > 248:
+			return 231
+		default:
+			return 232 + (r-8)*24/247
+		}
+	}
+	ri := r * 5 / 255
+	gi := g * 5 / 255
+	bi := b * 5 / 255
+	return 16 + 36*ri + 6*gi + bi
+}
+
+// ansi256ToRGB approximates the 24-bit color an xterm-256 index stands for,
+// for downconverting color(N) to basic-16 in --format=ansi.
+func ansi256ToRGB(idx int) (int, int, int) {
+	switch {
+	case idx >= 232:
+		v := 8 + (idx-232)*10
+		return v, v, v
+	case idx >= 16:
+		idx -= 16
+		r, g, b := idx/36, (idx/6)%6, idx%6
+		level := func(c int) int {
+			if c == 0 {
+				return 0
 			}
+			return 55 + c*40
+		}
+		return level(r), level(g), level(b)
+	default:
+		basic16RGB := [16][3]int{
+			{0, 0, 0}, {128, 0, 0}, {0, 128, 0}, {128, 128, 0},
+			{0, 0, 128}, {128, 0, 128}, {0, 128, 128}, {192, 192, 192},
+			{128, 128, 128}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+			{0, 0, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+		}
+		return basic16RGB[idx][0], basic16RGB[idx][1], basic16RGB[idx][2]
+	}
+}
+
+// rgbToBasic16 picks the nearest of the 8 base ANSI colors, bright or not,
+// for a 24-bit color. background adds the backgroundColor offset so the
+// returned value is ready to use as-is, the same way a parsed "bg ..."
+// colorize spec already bakes it in.
+func rgbToBasic16(r, g, b int, background bool) int {
+	idx := 0
+	if r > 90 {
+		idx |= 1
+	}
+	if g > 90 {
+		idx |= 2
+	}
+	if b > 90 {
+		idx |= 4
+	}
+	base := []int{Black, Red, Green, Yellow, Blue, Magenta, Cyan, White}[idx]
+
+	value := base
+	if background {
+		value += backgroundColor
+	}
+	if (r+g+b)/3 > 170 {
+		value += brightColor
+	}
+	return value
+}
+
+// ansiColorParams renders a Colorize color value (basic, 256-color or
+// truecolor) as the SGR parameters that select it, e.g. []string{"38","5","202"}
+// for a 256-color foreground. base is 38 for foreground, 48 for background.
+func ansiColorParams(value, base int) []string {
+	switch {
+	case value >= truecolorOffset:
+		rgb := value - truecolorOffset
+		return []string{
+			strconv.Itoa(base), "2",
+			strconv.Itoa((rgb >> 16) & 0xff),
+			strconv.Itoa((rgb >> 8) & 0xff),
+			strconv.Itoa(rgb & 0xff),
 		}
+	case value >= ansi256Offset:
+		return []string{strconv.Itoa(base), "5", strconv.Itoa(value - ansi256Offset)}
+	default:
+		return []string{strconv.Itoa(value)}
 	}
-	return c
 }
 
 func Property(name string, isset bool) int {
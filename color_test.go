@@ -0,0 +1,95 @@
+/* color_test.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import "testing"
+
+func TestRgbToAnsi256(t *testing.T) {
+	tests := []struct {
+		name    string
+		r, g, b int
+		want    int
+	}{
+		{"black corner of the cube", 0, 0, 0, 16},
+		{"white corner of the cube", 255, 255, 255, 231},
+		{"pure red", 255, 0, 0, 16 + 36*5},
+		{"dark gray on the ramp", 10, 10, 10, 232},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rgbToAnsi256(tt.r, tt.g, tt.b); got != tt.want {
+				t.Errorf("rgbToAnsi256(%d,%d,%d) = %d, want %d", tt.r, tt.g, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAnsi256ToRGBInRange(t *testing.T) {
+	// Every index a color(N) token can carry should decode to an RGB
+	// triplet whose channels all lie in 0-255, without panicking.
+	for idx := 0; idx < 256; idx++ {
+		r, g, b := ansi256ToRGB(idx)
+		for _, c := range []int{r, g, b} {
+			if c < 0 || c > 255 {
+				t.Fatalf("ansi256ToRGB(%d) produced out-of-range channel %d", idx, c)
+			}
+		}
+	}
+}
+
+func TestRgbToBasic16(t *testing.T) {
+	tests := []struct {
+		name       string
+		r, g, b    int
+		background bool
+		want       int
+	}{
+		{"black foreground", 0, 0, 0, false, Black},
+		{"bright white foreground", 255, 255, 255, false, White + brightColor},
+		{"pure blue background", 0, 0, 255, true, Blue + backgroundColor},
+		{"dim red foreground", 150, 0, 0, false, Red},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rgbToBasic16(tt.r, tt.g, tt.b, tt.background); got != tt.want {
+				t.Errorf("rgbToBasic16(%d,%d,%d,%v) = %d, want %d", tt.r, tt.g, tt.b, tt.background, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClampColorValue(t *testing.T) {
+	truecolorBlue := truecolorOffset + 0x0000ff
+	ansi256Idx := ansi256Offset + 196 // a bright red on the cube
+
+	tests := []struct {
+		name       string
+		value      int
+		format     OutputFormat
+		background bool
+		want       int
+	}{
+		{"truecolor format is a no-op", truecolorBlue, FormatTruecolor, false, truecolorBlue},
+		{"ansi256 format is a no-op on an already-256 value", ansi256Idx, FormatAnsi256, false, ansi256Idx},
+		{"ansi256 format downconverts truecolor", truecolorBlue, FormatAnsi256, false, ansi256Offset + rgbToAnsi256(0, 0, 255)},
+		{"ansi format downconverts truecolor to basic16", truecolorBlue, FormatAnsi, false, rgbToBasic16(0, 0, 255, false)},
+		{"ansi format downconverts ansi256 to basic16", ansi256Idx, FormatAnsi, true, func() int {
+			r, g, b := ansi256ToRGB(196)
+			return rgbToBasic16(r, g, b, true)
+		}()},
+		{"ansi format leaves a basic value alone", Green, FormatAnsi, false, Green},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clampColorValue(tt.value, tt.format, tt.background); got != tt.want {
+				t.Errorf("clampColorValue(%d, %q, %v) = %d, want %d", tt.value, tt.format, tt.background, got, tt.want)
+			}
+		})
+	}
+}
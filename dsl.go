@@ -0,0 +1,249 @@
+/* dsl.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Palette is a named, reusable colorize spec. A pattern's colorize section
+// can reference one with "use(NAME)" instead of repeating the same color
+// words in every rule that shares a look, e.g.:
+//
+//	palette errors { fg=red bold }
+//	/ERROR: (?P<msg>.*)/ msg:use(errors)
+type Palette map[string]Colorize
+
+var usePaletteRE = regexp.MustCompile(`^use\(\s*([A-Za-z0-9_-]+)\s*\)$`)
+
+// parseUsePalette reports whether value is a "use(NAME)" reference and, if
+// so, the palette name it names.
+func parseUsePalette(value string) (string, bool) {
+	m := usePaletteRE.FindStringSubmatch(value)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// ruleReader walks one rule file (and, via "include", the files it pulls
+// in), accumulating patterns and palettes. maxIncludeDepth bounds include
+// recursion so a cycle fails loudly instead of hanging.
+type ruleReader struct {
+	palettes Palette
+	depth    int
+}
+
+const maxIncludeDepth = 16
+
+// readPatternsFromFile parses filename's rule grammar: blank lines and "#"
+// comments as before, plus "palette NAME { ... }" blocks, "include PATH"
+// directives (resolved relative to filename's directory), "@when COND"
+// guards on the rule line that immediately follows them, and "use(NAME)" in
+// a pattern's colorize section. Errors carry filename:line so a malformed
+// rule file is easy to place; only an error in one of a pattern's
+// comma-separated group fields also carries a column. The
+// palettes it collected are returned too, so -e/--regexp patterns given on
+// the command line alongside --file can reference them as well.
+func readPatternsFromFile(filename string, rd io.Reader) ([]Pattern, Palette, error) {
+	r := &ruleReader{palettes: Palette{}}
+	patterns, err := r.read(filename, rd)
+	return patterns, r.palettes, err
+}
+
+func (r *ruleReader) read(filename string, rd io.Reader) ([]Pattern, error) {
+	r.depth++
+	defer func() { r.depth-- }()
+
+	if r.depth > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: include depth exceeds %d, likely a cycle", filename, maxIncludeDepth)
+	}
+
+	var (
+		line            string
+		readerErr       error
+		patterns        []Pattern
+		pendingWhen     string
+		pendingWhenLine int
+		havePending     bool
+	)
+	lineNum := 0
+	reader := bufio.NewReader(rd)
+
+	for readerErr == nil {
+		lineNum++
+		line, readerErr = reader.ReadString('\n')
+
+		if readerErr != nil && readerErr != io.EOF {
+			return patterns, readerErr
+		}
+
+		trimmed := strings.TrimSpace(line)
+
+		if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "@when ") {
+			pendingWhen = strings.TrimSpace(trimmed[len("@when "):])
+			pendingWhenLine = lineNum
+			havePending = true
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "include ") {
+			if havePending {
+				return patterns, fmt.Errorf("%s:%d: @when must be immediately followed by a rule, not include", filename, pendingWhenLine)
+			}
+			included, err := r.readInclude(filename, lineNum, strings.TrimSpace(trimmed[len("include "):]))
+			if err != nil {
+				return patterns, err
+			}
+			patterns = append(patterns, included...)
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "palette ") {
+			if havePending {
+				return patterns, fmt.Errorf("%s:%d: @when must be immediately followed by a rule, not palette", filename, pendingWhenLine)
+			}
+			name, body, err := readPaletteBlock(filename, lineNum, trimmed, reader, &lineNum)
+			if err != nil {
+				return patterns, err
+			}
+			data, err := ParseColorize(body)
+			if err != nil {
+				return patterns, fmt.Errorf("%s:%d: palette %s: %v", filename, lineNum, name, err)
+			}
+			r.palettes[name] = data
+			continue
+		}
+
+		active := true
+		if havePending {
+			var err error
+			active, err = evalWhen(pendingWhen)
+			if err != nil {
+				return patterns, fmt.Errorf("%s:%d: @when: %v", filename, lineNum, err)
+			}
+			havePending = false
+		}
+
+		pattern, err := parsePattern(filename, lineNum, line, r.palettes)
+		if err != nil {
+			return patterns, err
+		}
+		if active {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	if havePending {
+		return patterns, fmt.Errorf("%s:%d: @when must be immediately followed by a rule, not end of file", filename, pendingWhenLine)
+	}
+
+	return patterns, nil
+}
+
+func (r *ruleReader) readInclude(filename string, lineNum int, path string) ([]Pattern, error) {
+	path = strings.Trim(path, `"`)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(filename), path)
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%d: include %q: %v", filename, lineNum, path, err)
+	}
+	defer fd.Close()
+
+	return r.read(path, fd)
+}
+
+// readPaletteBlock reads a "palette NAME { ... }" block, which may span
+// several lines, and returns the palette name and its body with "=" turned
+// into the whitespace ParseColorize expects, so "fg=red" in a palette means
+// what "fg red" means in a pattern's colorize section. The "=" form is
+// accepted only inside palette blocks; ParseColorize itself rejects it.
+func readPaletteBlock(filename string, startLine int, header string, reader *bufio.Reader, lineNum *int) (name, body string, err error) {
+	open := strings.IndexByte(header, '{')
+	if open == -1 {
+		return "", "", fmt.Errorf("%s:%d: bad format: palette block missing '{'", filename, startLine)
+	}
+	name = strings.TrimSpace(header[len("palette"):open])
+	if len(name) == 0 {
+		return "", "", fmt.Errorf("%s:%d: bad format: palette without a name", filename, startLine)
+	}
+
+	buf := header[open+1:]
+	for !strings.ContainsRune(buf, '}') {
+		next, readErr := reader.ReadString('\n')
+		if readErr != nil && readErr != io.EOF {
+			return "", "", readErr
+		}
+		*lineNum++
+		buf += " " + strings.TrimRight(next, "\r\n")
+		if readErr == io.EOF {
+			break
+		}
+	}
+
+	close := strings.IndexByte(buf, '}')
+	if close == -1 {
+		return "", "", fmt.Errorf("%s:%d: bad format: palette %s missing '}'", filename, startLine, name)
+	}
+
+	return name, strings.ReplaceAll(buf[:close], "=", " "), nil
+}
+
+// evalWhen evaluates an "@when" guard, a "|"-separated list of conditions
+// matched if any one of them holds: "tty" (stdout is a terminal), "pipe"
+// (stdout is not a terminal) or "env(VAR=value)" (the environment variable
+// VAR is set to value).
+func evalWhen(cond string) (bool, error) {
+	for _, c := range strings.Split(cond, "|") {
+		c = strings.TrimSpace(c)
+		switch {
+		case c == "tty":
+			if isTerminal(os.Stdout) {
+				return true, nil
+			}
+		case c == "pipe":
+			if !isTerminal(os.Stdout) {
+				return true, nil
+			}
+		case strings.HasPrefix(c, "env(") && strings.HasSuffix(c, ")"):
+			expr := c[len("env(") : len(c)-1]
+			parts := strings.SplitN(expr, "=", 2)
+			if len(parts) != 2 {
+				return false, fmt.Errorf("bad env guard: %q", c)
+			}
+			if os.Getenv(strings.TrimSpace(parts[0])) == strings.TrimSpace(parts[1]) {
+				return true, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown guard: %q", c)
+		}
+	}
+	return false, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,121 @@
+/* dsl_test.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPatternsFromFileWhenGuard(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		env     map[string]string
+		want    int // number of patterns kept
+		wantErr string
+	}{
+		{
+			name: "matching env guard keeps the rule",
+			rule: "@when env(CF_TEST=on)\n/(?P<m>MAIN)/ m:fg red\n",
+			env:  map[string]string{"CF_TEST": "on"},
+			want: 1,
+		},
+		{
+			name: "non-matching env guard drops the rule",
+			rule: "@when env(CF_TEST=off)\n/(?P<m>MAIN)/ m:fg red\n",
+			env:  map[string]string{"CF_TEST": "on"},
+			want: 0,
+		},
+		{
+			name:    "dangling @when at end of file is an error",
+			rule:    "@when tty\n",
+			wantErr: "must be immediately followed by a rule",
+		},
+		{
+			name:    "@when followed by include is an error",
+			rule:    "@when tty\ninclude nope.cfilter\n",
+			wantErr: "must be immediately followed by a rule, not include",
+		},
+		{
+			name:    "@when followed by palette is an error",
+			rule:    "@when tty\npalette p { fg=red }\n",
+			wantErr: "must be immediately followed by a rule, not palette",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			patterns, _, err := readPatternsFromFile("rule", strings.NewReader(tt.rule))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(patterns) != tt.want {
+				t.Fatalf("got %d patterns, want %d", len(patterns), tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPatternsFromFilePalette(t *testing.T) {
+	rule := "palette errors { fg=red bold }\n/ERROR: (?P<msg>.*)/ msg:use(errors)\n"
+
+	patterns, palettes, err := readPatternsFromFile("rule", strings.NewReader(rule))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := palettes["errors"]; !ok {
+		t.Fatalf("palette %q was not collected", "errors")
+	}
+	if len(patterns) != 1 {
+		t.Fatalf("got %d patterns, want 1", len(patterns))
+	}
+	if _, ok := patterns[0].Groups[0].Colorize[BoldProperty]; !ok {
+		t.Fatalf("pattern's msg group did not inherit the palette's bold property")
+	}
+}
+
+func TestReadPatternsFromFileInclude(t *testing.T) {
+	dir := t.TempDir()
+	included := filepath.Join(dir, "inc.cfilter")
+	if err := os.WriteFile(included, []byte("/(?P<m>INCLUDED)/ m:fg green\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	main := filepath.Join(dir, "main.cfilter")
+	rule := "include inc.cfilter\n/(?P<m>MAIN)/ m:fg red\n"
+	if err := os.WriteFile(main, []byte(rule), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Open(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	patterns, _, err := readPatternsFromFile(main, fd)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(patterns) != 2 {
+		t.Fatalf("got %d patterns, want 2 (one included, one local)", len(patterns))
+	}
+}
@@ -0,0 +1,107 @@
+/* follow.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// followPoll is how often a followReader checks for new data once it has
+// caught up with the end of the file, the same tradeoff tail -f makes
+// between responsiveness and busy-polling.
+const followPoll = 250 * time.Millisecond
+
+// followReader wraps an open file so that reading past its current end
+// blocks and retries instead of returning io.EOF, letting processFile's
+// ordinary read loop tail a growing file with no special-casing of its own.
+//
+// When byName is true, the reader also re-stats path on every EOF to notice
+// the two ways log rotation shows up: the path now pointing at a different
+// inode (renamed-and-recreated, as logrotate does), or the same inode
+// reporting a smaller size (truncated in place, as some loggers do instead
+// of rotating). Either is handled by reopening: the first by path, the
+// second with a seek back to the start.
+type followReader struct {
+	path   string
+	byName bool
+	file   *os.File
+	size   int64
+	ino    uint64
+}
+
+// newFollowReader starts following file, already open at path. byName
+// enables rotation and truncation detection; without it a followReader just
+// keeps reading the file it already has open and notices neither.
+func newFollowReader(file *os.File, path string, byName bool) *followReader {
+	fr := &followReader{path: path, byName: byName, file: file}
+	if info, err := file.Stat(); err == nil {
+		fr.size = info.Size()
+		fr.ino = inodeOf(info)
+	}
+	return fr
+}
+
+func inodeOf(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ino
+	}
+	return 0
+}
+
+// Read never returns io.EOF: once it catches up with the end of the file it
+// sleeps and retries, watching for rotation/truncation along the way, until
+// more data appears or the file is replaced.
+func (fr *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := fr.file.Read(p)
+		if n > 0 {
+			fr.size += int64(n)
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if fr.byName {
+			fr.checkRotation()
+		}
+		time.Sleep(followPoll)
+	}
+}
+
+// checkRotation re-stats fr.path and reopens fr.file if it looks rotated or
+// truncated. Stat or reopen failures are left for the next poll to retry,
+// since the file may simply be mid-rotation.
+func (fr *followReader) checkRotation() {
+	info, err := os.Stat(fr.path)
+	if err != nil {
+		return
+	}
+
+	if ino := inodeOf(info); fr.ino != 0 && ino != fr.ino {
+		fd, err := os.Open(fr.path)
+		if err != nil {
+			return
+		}
+		fr.file.Close()
+		fr.file = fd
+		fr.ino = ino
+		fr.size = 0
+		return
+	}
+
+	if info.Size() < fr.size {
+		if _, err := fr.file.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		fr.size = 0
+	}
+}
@@ -0,0 +1,152 @@
+/* group.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// GroupRetention bounds how long a key's lines wait around for a trigger
+// before being dropped, and how many distinct keys GroupBuffer remembers at
+// all. A zero field means that limit does not apply; at least one of
+// MaxLines/MaxBytes/MaxAge should be set or a busy key buffers forever, and
+// MaxKeys should be set for a long-running process (e.g. under --follow)
+// that keys on something unbounded, like a request ID, or the number of
+// keyBuffers it holds grows for the life of the process.
+type GroupRetention struct {
+	MaxLines int
+	MaxBytes int
+	MaxAge   time.Duration
+	MaxKeys  int
+}
+
+type bufferedLine struct {
+	rendered []byte
+	seenAt   time.Time
+}
+
+type keyBuffer struct {
+	lines  []bufferedLine
+	bytes  int
+	active bool // a trigger already fired for this key; stream, don't buffer
+	elem   *list.Element
+}
+
+// GroupBuffer implements cfilter's "smart context" mode: lines are grouped
+// by a key extracted from a pattern group tagged "key" and held until either
+// the retention limit is hit or a pattern tagged "trigger" matches a line
+// carrying that key, at which point the whole held group is flushed,
+// colorized, in order. Once a key has triggered, its later lines are passed
+// straight through instead of buffered again.
+//
+// A GroupBuffer is safe for concurrent use, since a CommandFilter processes
+// stdout and stderr on separate goroutines but wants both streams folded
+// into the same groups.
+type GroupBuffer struct {
+	mu        sync.Mutex
+	retention GroupRetention
+	keys      map[string]*keyBuffer
+	lru       *list.List
+}
+
+func NewGroupBuffer(retention GroupRetention) *GroupBuffer {
+	return &GroupBuffer{
+		retention: retention,
+		keys:      make(map[string]*keyBuffer),
+		lru:       list.New(),
+	}
+}
+
+func (g *GroupBuffer) touch(key string) *keyBuffer {
+	kb, ok := g.keys[key]
+	if !ok {
+		kb = &keyBuffer{}
+		kb.elem = g.lru.PushBack(key)
+		g.keys[key] = kb
+		g.evictKeys()
+		return kb
+	}
+	g.lru.MoveToBack(kb.elem)
+	return kb
+}
+
+// evictKeys drops the least-recently-touched keys once there are more than
+// retention.MaxKeys of them, discarding whatever lines the dropped key had
+// buffered. This also evicts keys that already triggered (active: true),
+// since those hold no lines, just the fact that they already triggered; if a
+// later line for that same key arrives it simply buffers again as if seen
+// for the first time, which is an acceptable tradeoff for bounding memory
+// under a long-running --follow that keys on something unbounded.
+func (g *GroupBuffer) evictKeys() {
+	if g.retention.MaxKeys <= 0 {
+		return
+	}
+	for len(g.keys) > g.retention.MaxKeys {
+		oldest := g.lru.Front()
+		if oldest == nil {
+			return
+		}
+		g.lru.Remove(oldest)
+		delete(g.keys, oldest.Value.(string))
+	}
+}
+
+// Observe records rendered under key. If triggered is true, every line
+// buffered for key so far, followed by rendered, is returned for printing
+// and the key becomes active, so subsequent Observe calls for it return
+// their line immediately instead of buffering. Otherwise rendered is held
+// and nil is returned.
+func (g *GroupBuffer) Observe(key string, rendered []byte, triggered bool) [][]byte {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	kb := g.touch(key)
+
+	if kb.active {
+		return [][]byte{rendered}
+	}
+
+	if triggered {
+		flushed := make([][]byte, 0, len(kb.lines)+1)
+		for _, bl := range kb.lines {
+			flushed = append(flushed, bl.rendered)
+		}
+		flushed = append(flushed, rendered)
+
+		kb.lines = nil
+		kb.bytes = 0
+		kb.active = true
+
+		return flushed
+	}
+
+	now := time.Now()
+	kb.lines = append(kb.lines, bufferedLine{rendered: rendered, seenAt: now})
+	kb.bytes += len(rendered)
+	g.evict(kb, now)
+
+	return nil
+}
+
+func (g *GroupBuffer) evict(kb *keyBuffer, now time.Time) {
+	for len(kb.lines) > 0 {
+		oldest := kb.lines[0]
+		switch {
+		case g.retention.MaxLines > 0 && len(kb.lines) > g.retention.MaxLines:
+		case g.retention.MaxBytes > 0 && kb.bytes > g.retention.MaxBytes:
+		case g.retention.MaxAge > 0 && now.Sub(oldest.seenAt) > g.retention.MaxAge:
+		default:
+			return
+		}
+		kb.bytes -= len(oldest.rendered)
+		kb.lines = kb.lines[1:]
+	}
+}
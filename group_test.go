@@ -0,0 +1,138 @@
+/* group_test.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupBufferFlushesOnTrigger(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{})
+
+	if flushed := g.Observe("req-1", []byte("line1"), false); flushed != nil {
+		t.Fatalf("buffering a non-triggering line returned %v, want nil", flushed)
+	}
+	if flushed := g.Observe("req-1", []byte("line2"), false); flushed != nil {
+		t.Fatalf("buffering a non-triggering line returned %v, want nil", flushed)
+	}
+
+	flushed := g.Observe("req-1", []byte("line3-ERROR"), true)
+	want := [][]byte{[]byte("line1"), []byte("line2"), []byte("line3-ERROR")}
+	if len(flushed) != len(want) {
+		t.Fatalf("got %d flushed lines, want %d", len(flushed), len(want))
+	}
+	for i := range want {
+		if string(flushed[i]) != string(want[i]) {
+			t.Errorf("flushed[%d] = %q, want %q", i, flushed[i], want[i])
+		}
+	}
+
+	// Once triggered, a key streams straight through instead of buffering.
+	flushed = g.Observe("req-1", []byte("line4"), false)
+	if len(flushed) != 1 || string(flushed[0]) != "line4" {
+		t.Fatalf("post-trigger Observe = %v, want a single passthrough line", flushed)
+	}
+}
+
+func TestGroupBufferRetentionMaxLines(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{MaxLines: 2})
+
+	g.Observe("k", []byte("a"), false)
+	g.Observe("k", []byte("b"), false)
+	g.Observe("k", []byte("c"), false)
+
+	flushed := g.Observe("k", []byte("trigger"), true)
+	want := []string{"b", "c", "trigger"}
+	if len(flushed) != len(want) {
+		t.Fatalf("got %d flushed lines, want %d (%v)", len(flushed), len(want), want)
+	}
+	for i := range want {
+		if string(flushed[i]) != want[i] {
+			t.Errorf("flushed[%d] = %q, want %q", i, flushed[i], want[i])
+		}
+	}
+}
+
+func TestGroupBufferRetentionMaxBytes(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{MaxBytes: 5})
+
+	g.Observe("k", []byte("12345"), false) // exactly at the limit, kept
+	g.Observe("k", []byte("67"), false)    // pushes the key over the limit
+
+	flushed := g.Observe("k", []byte("!"), true)
+	want := []string{"67", "!"}
+	if len(flushed) != len(want) {
+		t.Fatalf("got %v, want %v", stringsOf(flushed), want)
+	}
+	for i := range want {
+		if string(flushed[i]) != want[i] {
+			t.Errorf("flushed[%d] = %q, want %q", i, flushed[i], want[i])
+		}
+	}
+}
+
+func TestGroupBufferRetentionMaxAge(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{MaxAge: 10 * time.Millisecond})
+
+	g.Observe("k", []byte("old"), false)
+	time.Sleep(20 * time.Millisecond)
+	g.Observe("k", []byte("new"), false)
+
+	flushed := g.Observe("k", []byte("trigger"), true)
+	want := []string{"new", "trigger"}
+	if len(flushed) != len(want) {
+		t.Fatalf("got %v, want %v", stringsOf(flushed), want)
+	}
+	for i := range want {
+		if string(flushed[i]) != want[i] {
+			t.Errorf("flushed[%d] = %q, want %q", i, flushed[i], want[i])
+		}
+	}
+}
+
+func TestGroupBufferMaxKeysEviction(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{MaxKeys: 2})
+
+	g.Observe("a", []byte("a1"), false)
+	g.Observe("b", []byte("b1"), false)
+	g.Observe("c", []byte("c1"), false) // should evict "a", the least-recently-touched key
+
+	if len(g.keys) != 2 {
+		t.Fatalf("got %d keys, want 2", len(g.keys))
+	}
+	if _, ok := g.keys["a"]; ok {
+		t.Fatalf("expected key %q to have been evicted", "a")
+	}
+	if _, ok := g.keys["b"]; !ok {
+		t.Fatalf("expected key %q to survive eviction", "b")
+	}
+	if _, ok := g.keys["c"]; !ok {
+		t.Fatalf("expected key %q to survive eviction", "c")
+	}
+}
+
+func TestGroupBufferMaxKeysEvictsActiveKeys(t *testing.T) {
+	g := NewGroupBuffer(GroupRetention{MaxKeys: 1})
+
+	g.Observe("a", []byte("a1"), true) // triggers and goes active, but still counts as a key
+	g.Observe("b", []byte("b1"), false)
+
+	if _, ok := g.keys["a"]; ok {
+		t.Fatalf("expected already-triggered key %q to be evictable like any other key", "a")
+	}
+}
+
+func stringsOf(lines [][]byte) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = string(l)
+	}
+	return out
+}
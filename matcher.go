@@ -0,0 +1,229 @@
+/* matcher.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"bufio"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// CombinedMatcher wraps every pattern's regexp in its own capturing group
+// and alternates them into one compiled regexp, so a line can be checked
+// against all patterns at once instead of with len(patterns) separate
+// regexp passes. It is only a prefilter: Candidates tells processFile which
+// patterns might match a line, but the real match (and its submatch
+// offsets) still comes from running that pattern's own Pattern.RE.
+//
+// The prefilter is approximate, not exhaustive: the combined regexp finds
+// non-overlapping matches with leftmost-first semantics, so if two
+// patterns' matches would start at the same offset, only the alternative
+// the combined regexp prefers is visible in that match; the other pattern
+// is silently not flagged there, even though its own Pattern.RE would have
+// matched. This trades perfect precision for doing one pass over most lines
+// instead of one per pattern, which is where cfilter spends most of its
+// time on a rule file with many patterns under --workers, so cfilter.go
+// only builds a CombinedMatcher when --workers makes that trade worthwhile;
+// plain, sequential usage matches every pattern independently instead, with
+// no cross-pattern interference.
+type CombinedMatcher struct {
+	re         *regexp.Regexp
+	groupOwner []int // groupOwner[g] is the pattern index owning capture group g; groupOwner[0] is unused (whole match)
+	npatterns  int
+}
+
+// NewCombinedMatcher compiles the alternation for patterns. It returns a nil
+// matcher, not an error, for an empty pattern set.
+func NewCombinedMatcher(patterns []Pattern) (*CombinedMatcher, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+
+	var b strings.Builder
+	groupOwner := []int{-1}
+
+	for n, pattern := range patterns {
+		if n > 0 {
+			b.WriteByte('|')
+		}
+		b.WriteByte('(')
+		b.WriteString(pattern.RE.String())
+		b.WriteByte(')')
+
+		groupOwner = append(groupOwner, n)
+		for g := 0; g < pattern.RE.NumSubexp(); g++ {
+			groupOwner = append(groupOwner, n)
+		}
+	}
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &CombinedMatcher{re: re, groupOwner: groupOwner, npatterns: len(patterns)}, nil
+}
+
+// Candidates reports, for line, which pattern indices might match somewhere
+// in it.
+func (m *CombinedMatcher) Candidates(line []byte) []bool {
+	flagged := make([]bool, m.npatterns)
+
+	for _, match := range m.re.FindAllSubmatchIndex(line, -1) {
+		for g := 1; g < len(m.groupOwner); g++ {
+			if match[g*2] != -1 {
+				flagged[m.groupOwner[g]] = true
+			}
+		}
+	}
+
+	return flagged
+}
+
+// lineMatch is the result of matching one line against every pattern: the
+// spans to colorize, and whatever the smart-context grouping in group.go
+// needs to know about that line.
+type lineMatch struct {
+	seq         int
+	line        []byte
+	lineMatches bool
+	triggered   bool
+	key         string
+	spans       []MatchSpan
+	// hits[n] is true if patterns[n] matched this line, regardless of
+	// whether it contributed any colorized spans. Used by the
+	// --interactive viewer to jump between a single rule's matches.
+	hits []bool
+}
+
+// matchLine runs patterns against line, using combined (when non-nil) to
+// skip patterns that can't possibly match. It does no rendering or writing,
+// so it is safe to call from multiple goroutines at once, each on its own
+// line.
+func matchLine(patterns []Pattern, combined *CombinedMatcher, seq int, line []byte) lineMatch {
+	var candidates []bool
+	if combined != nil {
+		candidates = combined.Candidates(line)
+	}
+
+	result := lineMatch{seq: seq, line: line, hits: make([]bool, len(patterns))}
+
+	for n, pattern := range patterns {
+		if candidates != nil && !candidates[n] {
+			continue
+		}
+
+		res := pattern.RE.FindAllSubmatchIndex(line, -1)
+		if res == nil {
+			continue
+		}
+		result.lineMatches = true
+		result.hits[n] = true
+		if pattern.Trigger {
+			result.triggered = true
+		}
+		for i, grp := range pattern.Groups {
+			for _, match := range res {
+				pos := grp.Number * 2
+				if match[pos] == match[pos+1] {
+					continue
+				}
+				if grp.IsKey {
+					result.key = string(line[match[pos]:match[pos+1]])
+					continue
+				}
+				result.spans = append(result.spans, MatchSpan{
+					Group:    grp.Name,
+					Order:    n,
+					Start:    match[pos],
+					End:      match[pos+1],
+					Colorize: pattern.Groups[i].Colorize,
+				})
+			}
+		}
+	}
+
+	if len(result.spans) > 1 {
+		sort.Slice(result.spans, func(i, j int) bool { return result.spans[i].Start < result.spans[j].Start })
+	}
+
+	return result
+}
+
+// matchLinesConcurrently pipelines rd's lines through a pool of workers
+// matcher goroutines and calls emit, in the original line order, for each
+// result. Order is restored by sequence number rather than by waiting for
+// each line in turn, so a slow pattern on one line doesn't stall the
+// workers matching the lines after it.
+func matchLinesConcurrently(patterns []Pattern, combined *CombinedMatcher, rd io.Reader, workers int, emit func(lineMatch) error) error {
+	jobs := make(chan lineMatch, workers*2)
+	results := make(chan lineMatch, workers*2)
+
+	var workerWg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		workerWg.Add(1)
+		go func() {
+			defer workerWg.Done()
+			for job := range jobs {
+				results <- matchLine(patterns, combined, job.seq, job.line)
+			}
+		}()
+	}
+
+	var readErr error
+	go func() {
+		defer close(jobs)
+		reader := bufio.NewReaderSize(rd, bufferSize)
+		seq := 0
+		for {
+			line, err := reader.ReadSlice('\n')
+			if err == bufio.ErrBufferFull {
+				err = nil
+			}
+			if len(line) > 0 {
+				jobs <- lineMatch{seq: seq, line: append([]byte(nil), line...)}
+				seq++
+			}
+			if err != nil {
+				if err != io.EOF {
+					readErr = err
+				}
+				return
+			}
+		}
+	}()
+
+	go func() {
+		workerWg.Wait()
+		close(results)
+	}()
+
+	pending := map[int]lineMatch{}
+	next := 0
+
+	for res := range results {
+		pending[res.seq] = res
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if err := emit(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return readErr
+}
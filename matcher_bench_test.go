@@ -0,0 +1,81 @@
+/* matcher_bench_test.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchPatterns builds n patterns, each matching its own literal keyword, to
+// stand in for a rule file with many patterns.
+func benchPatterns(n int) []Pattern {
+	patterns := make([]Pattern, n)
+	for i := 0; i < n; i++ {
+		pattern, err := parsePattern("bench", i, fmt.Sprintf("/keyword%d:(?P<m>\\d+)/ m:fg red", i), Palette{})
+		if err != nil {
+			panic(err)
+		}
+		patterns[i] = pattern
+	}
+	return patterns
+}
+
+// benchLine builds a line that only the last pattern in a many-pattern set
+// matches, so the prefilter has to rule out every earlier pattern.
+func benchLine(n int) []byte {
+	return []byte(fmt.Sprintf("some unrelated log text keyword%d:123 trailing\n", n-1))
+}
+
+func BenchmarkMatchLineNoPrefilter(b *testing.B) {
+	patterns := benchPatterns(100)
+	line := benchLine(100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matchLine(patterns, nil, i, line)
+	}
+}
+
+func BenchmarkMatchLineWithPrefilter(b *testing.B) {
+	patterns := benchPatterns(100)
+	combined, err := NewCombinedMatcher(patterns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	line := benchLine(100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		matchLine(patterns, combined, i, line)
+	}
+}
+
+func BenchmarkMatchLinesConcurrently(b *testing.B) {
+	patterns := benchPatterns(100)
+	combined, err := NewCombinedMatcher(patterns)
+	if err != nil {
+		b.Fatal(err)
+	}
+	line := benchLine(100)
+
+	var lines strings.Builder
+	for i := 0; i < 1000; i++ {
+		lines.Write(line)
+	}
+	input := lines.String()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := matchLinesConcurrently(patterns, combined, strings.NewReader(input), 4, func(lineMatch) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
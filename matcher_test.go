@@ -0,0 +1,84 @@
+/* matcher_test.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import "testing"
+
+func mustPattern(t *testing.T, line string) Pattern {
+	t.Helper()
+	pattern, err := parsePattern("test", 1, line, Palette{})
+	if err != nil {
+		t.Fatalf("parsePattern(%q): %v", line, err)
+	}
+	return pattern
+}
+
+// TestMatchLineWithoutPrefilterIsExact covers the case every invocation uses
+// by default (cfilter.go only builds a CombinedMatcher when --workers>1):
+// every pattern is matched independently, so two patterns whose matches
+// start at the same offset are both reported, with no cross-pattern
+// interference.
+func TestMatchLineWithoutPrefilterIsExact(t *testing.T) {
+	patterns := []Pattern{
+		mustPattern(t, "/(?P<a>ERROR)/ a:fg red"),
+		mustPattern(t, "/(?P<b>ERROR)/ b:fg green"),
+	}
+
+	result := matchLine(patterns, nil, 0, []byte("ERROR here"))
+
+	if !result.hits[0] || !result.hits[1] {
+		t.Fatalf("hits = %v, want both patterns to match", result.hits)
+	}
+	if len(result.spans) != 2 {
+		t.Fatalf("got %d spans, want 2 (one per pattern)", len(result.spans))
+	}
+}
+
+// TestCombinedMatcherCandidatesDistinctOffsets checks the prefilter's normal,
+// correct case: patterns that match at different offsets are both flagged.
+func TestCombinedMatcherCandidatesDistinctOffsets(t *testing.T) {
+	patterns := []Pattern{
+		mustPattern(t, "/(?P<a>FOO)/ a:fg red"),
+		mustPattern(t, "/(?P<b>BAR)/ b:fg green"),
+	}
+	combined, err := NewCombinedMatcher(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := combined.Candidates([]byte("FOO then BAR"))
+	if !candidates[0] || !candidates[1] {
+		t.Fatalf("candidates = %v, want both patterns flagged", candidates)
+	}
+}
+
+// TestCombinedMatcherCandidatesSameOffsetIsApproximate documents the
+// prefilter's known, accepted limitation (see CombinedMatcher's doc
+// comment): when two patterns' matches start at the same offset, only the
+// alternative the combined regexp prefers is visible, so the other pattern
+// is not flagged there even though its own Pattern.RE would match. This is
+// why cfilter.go only wires CombinedMatcher in under --workers.
+func TestCombinedMatcherCandidatesSameOffsetIsApproximate(t *testing.T) {
+	patterns := []Pattern{
+		mustPattern(t, "/(?P<a>ERROR)/ a:fg red"),
+		mustPattern(t, "/(?P<b>ERROR)/ b:fg green"),
+	}
+	combined, err := NewCombinedMatcher(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	candidates := combined.Candidates([]byte("ERROR here"))
+	if !candidates[0] {
+		t.Fatalf("candidates = %v, want the first alternative flagged", candidates)
+	}
+	if candidates[1] {
+		t.Fatalf("candidates = %v, the approximate prefilter is expected to miss the second alternative here", candidates)
+	}
+}
@@ -0,0 +1,318 @@
+/* renderer.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+// OutputFormat selects which Renderer processFile writes matched lines with.
+type OutputFormat string
+
+const (
+	FormatAnsi      OutputFormat = "ansi"
+	FormatAnsi256   OutputFormat = "ansi256"
+	FormatTruecolor OutputFormat = "truecolor"
+	FormatHTML      OutputFormat = "html"
+	FormatJSON      OutputFormat = "json"
+)
+
+// MatchSpan is one matched, colorized region of a line. Spans may nest
+// (a named group inside the whole pattern match) but are not expected to
+// cross each other.
+type MatchSpan struct {
+	Group    string
+	Order    int
+	Start    int
+	End      int
+	Colorize Colorize
+}
+
+// Renderer turns a line together with the spans matched within it into
+// output written to wr. lineMatches is true when the line matched at least
+// one pattern, even if that pattern carried no colorized groups.
+type Renderer interface {
+	RenderLine(wr io.Writer, line []byte, spans []MatchSpan, lineMatches bool) error
+}
+
+// NewRenderer builds the Renderer for format. npatterns sizes the internal
+// state the ansi family keeps per pattern; cssClass is only used by html.
+func NewRenderer(format OutputFormat, npatterns int, cssClass string) (Renderer, error) {
+	switch format {
+	case "":
+		return newAnsiRenderer(npatterns, FormatAnsi), nil
+	case FormatAnsi, FormatAnsi256, FormatTruecolor:
+		return newAnsiRenderer(npatterns, format), nil
+	case FormatHTML:
+		return &htmlRenderer{cssClass: cssClass}, nil
+	case FormatJSON:
+		return &jsonRenderer{}, nil
+	}
+	return nil, fmt.Errorf("unknown output format: %q", format)
+}
+
+// ansiRenderer reproduces cfilter's original coloring: a sweep over the
+// start/end boundaries of every span, tracking, per pattern, which color and
+// properties are currently "open" so that overlapping groups merge the same
+// way they always have. format bounds how rich a color it will emit: a
+// Colorize value parsed from #rrggbb or color(N) is downconverted to what
+// format can display, see clampColorValue.
+type ansiRenderer struct {
+	format     OutputFormat
+	colorFG    []int
+	colorBG    []int
+	properties map[string]int
+}
+
+func newAnsiRenderer(npatterns int, format OutputFormat) *ansiRenderer {
+	return &ansiRenderer{
+		format:     format,
+		colorFG:    make([]int, npatterns),
+		colorBG:    make([]int, npatterns),
+		properties: make(map[string]int, len(AnsiProperties)),
+	}
+}
+
+func (r *ansiRenderer) RenderLine(wr io.Writer, line []byte, spans []MatchSpan, lineMatches bool) error {
+	if len(spans) == 0 {
+		if lineMatches {
+			_, err := wr.Write(line)
+			return err
+		}
+		return nil
+	}
+
+	positions := spansToPositions(spans)
+	sort.Sort(positions)
+
+	lineOffset := 0
+	prevEscape := ""
+
+	for _, pos := range positions {
+		if lineOffset < pos.Offset {
+			wr.Write(line[lineOffset:pos.Offset])
+			lineOffset = pos.Offset
+		}
+		if lineOffset != pos.Offset {
+			continue
+		}
+
+		switch pos.Kind {
+		case LinePositionStartKind:
+			for k := range AnsiProperties {
+				if _, ok := pos.Colorize[k]; ok {
+					r.properties[k]++
+				}
+			}
+			r.colorFG[pos.Order] = pos.Colorize[ForegroundColor]
+			r.colorBG[pos.Order] = pos.Colorize[BackgroundColor]
+		case LinePositionEndKind:
+			for k := range AnsiProperties {
+				if _, ok := pos.Colorize[k]; ok {
+					r.properties[k]--
+				}
+			}
+			r.colorFG[pos.Order] = 0
+			r.colorBG[pos.Order] = 0
+		}
+
+		var foundFG, foundBG int
+
+		for n := len(r.colorFG) - 1; n >= 0 && (foundFG == 0 || foundBG == 0); n-- {
+			if foundFG == 0 && r.colorFG[n] > 0 {
+				foundFG = r.colorFG[n]
+			}
+			if foundBG == 0 && r.colorBG[n] > 0 {
+				foundBG = r.colorBG[n]
+			}
+		}
+		if foundFG == 0 {
+			foundFG = ResetForeground
+		}
+		if foundBG == 0 {
+			foundBG = ResetBackground
+		}
+		foundFG = clampColorValue(foundFG, r.format, false)
+		foundBG = clampColorValue(foundBG, r.format, true)
+
+		params := []string{}
+		for k, v := range r.properties {
+			if v > 0 {
+				params = append(params, fmt.Sprintf("%d", Property(k, true)))
+			} else if v < 0 {
+				r.properties[k] = 0
+			}
+		}
+		params = append(params, ansiColorParams(foundFG, 38)...)
+		params = append(params, ansiColorParams(foundBG, 48)...)
+
+		escape := AnsiStart + strings.Join(params, ";") + "m"
+
+		if prevEscape != escape {
+			wr.Write([]byte(escape))
+			prevEscape = escape
+		}
+	}
+	_, err := wr.Write(line[lineOffset:])
+	return err
+}
+
+// spansToPositions expands each MatchSpan into the start/end boundary pair
+// the sweep in RenderLine consumes.
+func spansToPositions(spans []MatchSpan) LinePositions {
+	positions := make(LinePositions, 0, len(spans)*2)
+	for _, s := range spans {
+		positions = append(positions,
+			&LinePosition{Kind: LinePositionStartKind, Order: s.Order, Offset: s.Start, Colorize: s.Colorize},
+			&LinePosition{Kind: LinePositionEndKind, Order: s.Order, Offset: s.End, Colorize: s.Colorize},
+		)
+	}
+	return positions
+}
+
+// htmlRenderer wraps every matched span in its own <span>, nesting naturally
+// when spans overlap (e.g. a named group inside its pattern's whole match).
+// With cssClass set, spans get a "<cssClass>-<group>" class instead of an
+// inline style, so the caller supplies the actual colors via stylesheet.
+type htmlRenderer struct {
+	cssClass string
+}
+
+type htmlEvent struct {
+	offset int
+	start  bool
+	span   MatchSpan
+}
+
+func (r *htmlRenderer) RenderLine(wr io.Writer, line []byte, spans []MatchSpan, lineMatches bool) error {
+	if len(spans) == 0 {
+		if lineMatches {
+			_, err := wr.Write(line)
+			return err
+		}
+		return nil
+	}
+
+	events := make([]htmlEvent, 0, len(spans)*2)
+	for _, s := range spans {
+		events = append(events, htmlEvent{s.Start, true, s}, htmlEvent{s.End, false, s})
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].offset != events[j].offset {
+			return events[i].offset < events[j].offset
+		}
+		return !events[i].start && events[j].start
+	})
+
+	last := 0
+	for _, e := range events {
+		if e.offset > last {
+			io.WriteString(wr, html.EscapeString(string(line[last:e.offset])))
+			last = e.offset
+		}
+		if e.start {
+			if len(r.cssClass) > 0 {
+				fmt.Fprintf(wr, `<span class="%s-%s">`, r.cssClass, e.span.Group)
+			} else {
+				fmt.Fprintf(wr, `<span style="%s">`, cssStyle(e.span.Colorize))
+			}
+		} else {
+			io.WriteString(wr, "</span>")
+		}
+	}
+	_, err := io.WriteString(wr, html.EscapeString(string(line[last:])))
+	return err
+}
+
+// cssStyle renders a Colorize as inline CSS, used by the html format when no
+// --css-class was given.
+func cssStyle(c Colorize) string {
+	var rules []string
+	if v, ok := c[ForegroundColor]; ok && v > 0 {
+		rules = append(rules, "color:"+cssColor(v))
+	}
+	if v, ok := c[BackgroundColor]; ok && v > 0 {
+		rules = append(rules, "background-color:"+cssColor(v))
+	}
+	if _, ok := c[BoldProperty]; ok {
+		rules = append(rules, "font-weight:bold")
+	}
+	if _, ok := c[UnderlineProperty]; ok {
+		rules = append(rules, "text-decoration:underline")
+	}
+	if _, ok := c[InverseProperty]; ok {
+		rules = append(rules, "filter:invert(1)")
+	}
+	return strings.Join(rules, ";")
+}
+
+func cssColor(value int) string {
+	if value >= truecolorOffset {
+		rgb := value - truecolorOffset
+		return fmt.Sprintf("#%06x", rgb)
+	}
+	if value >= ansi256Offset {
+		return fmt.Sprintf("var(--ansi256-%d)", value-ansi256Offset)
+	}
+	for name, code := range AnsiColors {
+		if code == value || code+backgroundColor == value {
+			return name
+		}
+	}
+	return "inherit"
+}
+
+// jsonRenderer emits one JSON object per matching input line: the line text
+// and the spans matched within it (a line no pattern matched emits nothing), rather than bytes the way the ansi/html formats
+// do. It never writes escape sequences or markup into the line itself.
+type jsonRenderer struct{}
+
+type jsonMatch struct {
+	Group string `json:"group"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+	Style string `json:"style"`
+}
+
+type jsonLine struct {
+	Line    string      `json:"line"`
+	Matches []jsonMatch `json:"matches"`
+}
+
+func (r *jsonRenderer) RenderLine(wr io.Writer, line []byte, spans []MatchSpan, lineMatches bool) error {
+	if !lineMatches {
+		return nil
+	}
+
+	matches := make([]jsonMatch, 0, len(spans))
+	for _, s := range spans {
+		matches = append(matches, jsonMatch{
+			Group: s.Group,
+			Start: s.Start,
+			End:   s.End,
+			Style: cssStyle(s.Colorize),
+		})
+	}
+
+	enc, err := json.Marshal(jsonLine{
+		Line:    strings.TrimRight(string(line), "\n"),
+		Matches: matches,
+	})
+	if err != nil {
+		return err
+	}
+	enc = append(enc, '\n')
+	_, err = wr.Write(enc)
+	return err
+}
@@ -0,0 +1,495 @@
+/* viewer.go
+ *
+ * This file is part of cfilter
+ * Copyright (C) 2017  Alexey Gladkov <gladkov.alexey@gmail.com>
+ *
+ * This file is covered by the GNU General Public License,
+ * which should be included with cfilter as the file COPYING.
+ */
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// ringRecord is one scrollback line kept by the interactive viewer: the raw
+// line plus enough of matchLine's result (see lineMatch) to re-render it
+// after a rule is toggled on or off, or to jump to it as one rule's next
+// match.
+type ringRecord struct {
+	line        []byte
+	lineMatches bool
+	spans       []MatchSpan
+	hits        []bool
+}
+
+// Viewer is cfilter's --interactive / "cfilter view" mode: an in-memory
+// scrollback ring fed from the usual processFile pipeline over a lineMatch
+// channel, browsed full-screen like less -R, with per-rule toggles and
+// incremental search layered on top. The same Pattern/matchLine data that
+// drives plain colorized output drives the viewer; only the presentation
+// differs.
+type Viewer struct {
+	mu       sync.Mutex
+	patterns []Pattern
+	enabled  []bool
+	max      int
+	lines    []ringRecord
+}
+
+// NewViewer creates a viewer over patterns, every rule enabled, keeping at
+// most maxLines of scrollback (0 means unbounded).
+func NewViewer(patterns []Pattern, maxLines int) *Viewer {
+	enabled := make([]bool, len(patterns))
+	for i := range enabled {
+		enabled[i] = true
+	}
+	return &Viewer{patterns: patterns, enabled: enabled, max: maxLines}
+}
+
+// Feed consumes processFile's records channel until it is closed, appending
+// every line to the scrollback ring and dropping the oldest past max.
+func (v *Viewer) Feed(records <-chan lineMatch) {
+	for m := range records {
+		v.mu.Lock()
+		v.lines = append(v.lines, ringRecord{
+			line:        m.line,
+			lineMatches: m.lineMatches,
+			spans:       m.spans,
+			hits:        m.hits,
+		})
+		if v.max > 0 && len(v.lines) > v.max {
+			v.lines = v.lines[len(v.lines)-v.max:]
+		}
+		v.mu.Unlock()
+	}
+}
+
+// visibleSpans filters m's spans down to the ones whose owning rule is
+// still enabled.
+func (v *Viewer) visibleSpans(m ringRecord) []MatchSpan {
+	var spans []MatchSpan
+	for _, s := range m.spans {
+		if v.enabled[s.Order] {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+func (v *Viewer) toggle(rule int) {
+	if rule < 0 || rule >= len(v.enabled) {
+		return
+	}
+	v.mu.Lock()
+	v.enabled[rule] = !v.enabled[rule]
+	v.mu.Unlock()
+}
+
+// snapshot returns a copy of the current scrollback and enabled state,
+// cheap enough to take on every redraw without holding the lock while
+// rendering.
+func (v *Viewer) snapshot() ([]ringRecord, []bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	lines := make([]ringRecord, len(v.lines))
+	copy(lines, v.lines)
+	enabled := make([]bool, len(v.enabled))
+	copy(enabled, v.enabled)
+	return lines, enabled
+}
+
+// viewerUI holds the interactive viewer's terminal state: scroll position,
+// incremental search, and which rule (if any) is selected for
+// jump-to-next-match.
+type viewerUI struct {
+	viewer   *Viewer
+	renderer Renderer
+	out      *bufio.Writer
+
+	top      int
+	selected int  // -1, or the rule index n/N jumps matches for
+	follow   bool // keep the view pinned to the newest line, like tail
+	search   string
+	entering bool // currently typing a "/" search query
+	status   string
+}
+
+// runInteractive puts stdin into raw mode and drives a full-screen viewer
+// over patterns, fed by records, until the user quits with 'q' or input
+// ends. maxLines bounds scrollback; see Viewer.
+func runInteractive(patterns []Pattern, records <-chan lineMatch, maxLines int) error {
+	viewer := NewViewer(patterns, maxLines)
+	go viewer.Feed(records)
+
+	renderer, err := NewRenderer(FormatAnsi, len(patterns), "")
+	if err != nil {
+		return err
+	}
+
+	saved, err := enableRawMode(os.Stdin.Fd())
+	if err != nil {
+		return fmt.Errorf("--interactive requires a terminal on stdin: %v", err)
+	}
+	defer restoreMode(os.Stdin.Fd(), saved)
+
+	ui := &viewerUI{
+		viewer:   viewer,
+		renderer: renderer,
+		out:      bufio.NewWriter(os.Stdout),
+		selected: -1,
+		follow:   true,
+	}
+	defer ui.out.Flush()
+
+	fmt.Fprint(ui.out, "\033[?1049h") // switch to the alternate screen
+	defer fmt.Fprint(ui.out, "\033[?1049l")
+
+	return ui.run()
+}
+
+// run drives the viewer until 'q' or stdin closes. Redraws happen both on
+// keypress and on a timer, since records keeps arriving in the background
+// (from input still being read) with no keypress to prompt a repaint.
+func (ui *viewerUI) run() error {
+	keys := make(chan rune)
+	go func() {
+		in := bufio.NewReader(os.Stdin)
+		for {
+			r, _, err := in.ReadRune()
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- r
+		}
+	}()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	ui.draw()
+
+	for {
+		select {
+		case r, ok := <-keys:
+			if !ok {
+				return nil
+			}
+			if ui.entering {
+				ui.handleSearchKey(r)
+				ui.draw()
+				continue
+			}
+
+			switch r {
+			case 'q':
+				return nil
+			case 'j':
+				ui.follow = false
+				ui.scroll(1)
+			case 'k':
+				ui.follow = false
+				ui.scroll(-1)
+			case ' ', 'f':
+				ui.follow = false
+				ui.scroll(ui.pageSize())
+			case 'b':
+				ui.follow = false
+				ui.scroll(-ui.pageSize())
+			case 'g':
+				ui.follow = false
+				ui.top = 0
+			case 'G':
+				ui.follow = true
+			case '/':
+				ui.entering = true
+				ui.search = ""
+				ui.status = "search: "
+			case 'n':
+				ui.jumpMatch(1)
+			case 'N':
+				ui.jumpMatch(-1)
+			case 'w':
+				ui.dumpBuffer()
+			default:
+				if r >= '1' && r <= '9' {
+					rule := int(r - '1')
+					ui.viewer.toggle(rule)
+					ui.selected = rule
+					ui.follow = false
+					ui.status = fmt.Sprintf("rule %d selected; n/N jumps its matches", rule+1)
+				}
+			}
+			ui.draw()
+		case <-ticker.C:
+			ui.draw()
+		}
+	}
+}
+
+// handleSearchKey feeds r into an in-progress "/" query. It returns true if
+// it consumed r as part of search entry (so the caller should not also
+// treat r as a normal key binding).
+func (ui *viewerUI) handleSearchKey(r rune) bool {
+	switch r {
+	case '\r', '\n':
+		ui.entering = false
+		ui.selected = -1
+		if len(ui.search) > 0 {
+			ui.follow = false
+			ui.status = fmt.Sprintf("search: %q (n/N to jump)", ui.search)
+			ui.jumpMatch(1)
+		} else {
+			ui.status = ""
+		}
+	case 27: // Escape
+		ui.entering = false
+		ui.search = ""
+		ui.status = ""
+	case 127, 8: // Backspace
+		if len(ui.search) > 0 {
+			ui.search = ui.search[:len(ui.search)-1]
+		}
+		ui.status = "search: " + ui.search
+	default:
+		ui.search += string(r)
+		ui.status = "search: " + ui.search
+	}
+	return true
+}
+
+func (ui *viewerUI) pageSize() int {
+	rows, _ := termSize(os.Stdout.Fd())
+	if rows <= 2 {
+		return 1
+	}
+	return rows - 2
+}
+
+func (ui *viewerUI) maxTop() int {
+	lines, _ := ui.viewer.snapshot()
+	return maxTopFor(len(lines), ui.pageSize())
+}
+
+func maxTopFor(nlines, rows int) int {
+	if nlines <= rows {
+		return 0
+	}
+	return nlines - rows
+}
+
+func (ui *viewerUI) scroll(delta int) {
+	ui.top += delta
+	if ui.top < 0 {
+		ui.top = 0
+	}
+	if max := ui.maxTop(); ui.top > max {
+		ui.top = max
+	}
+}
+
+// matches reports whether rec is a hit for the active search query or
+// selected rule, whichever is set.
+func (ui *viewerUI) matches(rec ringRecord) bool {
+	if len(ui.search) > 0 {
+		return bytes.Contains(rec.line, []byte(ui.search))
+	}
+	if ui.selected >= 0 && ui.selected < len(rec.hits) {
+		return rec.hits[ui.selected]
+	}
+	return false
+}
+
+// jumpMatch scrolls to the next (dir > 0) or previous (dir < 0) line
+// matching the active search or selected rule.
+func (ui *viewerUI) jumpMatch(dir int) {
+	lines, _ := ui.viewer.snapshot()
+	if len(ui.search) == 0 && ui.selected < 0 {
+		return
+	}
+	for i := ui.top + dir; i >= 0 && i < len(lines); i += dir {
+		if ui.matches(lines[i]) {
+			ui.top = i
+			return
+		}
+	}
+	ui.status += " (no more matches)"
+}
+
+// dumpBuffer writes the current scrollback, rendered with the viewer's
+// current rule toggles applied, to a timestamped file in the working
+// directory.
+func (ui *viewerUI) dumpBuffer() {
+	lines, enabled := ui.viewer.snapshot()
+	name := fmt.Sprintf("cfilter-dump-%d.log", time.Now().Unix())
+
+	fd, err := os.Create(name)
+	if err != nil {
+		ui.status = fmt.Sprintf("dump failed: %v", err)
+		return
+	}
+	defer fd.Close()
+
+	wr := bufio.NewWriter(fd)
+	for _, rec := range lines {
+		spans := rec.spans
+		if hasDisabled(enabled) {
+			spans = filterSpans(rec.spans, enabled)
+		}
+		if err := ui.renderer.RenderLine(wr, rec.line, spans, rec.lineMatches); err != nil {
+			ui.status = fmt.Sprintf("dump failed: %v", err)
+			return
+		}
+	}
+	wr.Flush()
+
+	ui.status = fmt.Sprintf("dumped %d lines to %s", len(lines), name)
+}
+
+func hasDisabled(enabled []bool) bool {
+	for _, e := range enabled {
+		if !e {
+			return true
+		}
+	}
+	return false
+}
+
+func filterSpans(spans []MatchSpan, enabled []bool) []MatchSpan {
+	var out []MatchSpan
+	for _, s := range spans {
+		if enabled[s.Order] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// draw repaints the whole screen: a sidebar listing the first nine rules
+// (those with a 1-9 toggle key) with their on/off state, the visible page of
+// scrollback, and a status line.
+func (ui *viewerUI) draw() {
+	rows, cols := termSize(os.Stdout.Fd())
+	lines, enabled := ui.viewer.snapshot()
+
+	if ui.follow {
+		ui.top = maxTopFor(len(lines), ui.pageSize())
+	}
+
+	sidebarWidth := 0
+	for n := range ui.viewer.patterns {
+		if n >= 9 {
+			break
+		}
+		if w := len(fmt.Sprintf("[%d] %s", n+1, ui.viewer.patterns[n].RE.String())) + 1; w > sidebarWidth {
+			sidebarWidth = w
+		}
+	}
+	if sidebarWidth > cols/3 {
+		sidebarWidth = cols / 3
+	}
+
+	fmt.Fprint(ui.out, "\033[2J\033[H")
+
+	body := rows - 2
+	if body < 0 {
+		body = 0
+	}
+
+	start := ui.top
+	for i := 0; i < body; i++ {
+		idx := start + i
+		fmt.Fprintf(ui.out, "\033[%d;1H", i+1)
+		if idx < len(lines) {
+			rec := lines[idx]
+			var buf bytes.Buffer
+			spans := ui.viewer.visibleSpans(rec)
+			ui.renderer.RenderLine(&buf, rec.line, spans, rec.lineMatches)
+			line := bytes.TrimRight(buf.Bytes(), "\r\n")
+			if sidebarWidth > 0 && len(line) > cols-sidebarWidth {
+				line = line[:cols-sidebarWidth]
+			}
+			ui.out.Write(line)
+		}
+		if sidebarWidth > 0 {
+			fmt.Fprintf(ui.out, "\033[%d;%dH", i+1, cols-sidebarWidth+1)
+			if i < len(ui.viewer.patterns) && i < 9 {
+				state := "on "
+				if !enabled[i] {
+					state = "off"
+				}
+				fmt.Fprintf(ui.out, "[%d %s] %.*s", i+1, state, sidebarWidth-8, ui.viewer.patterns[i].RE.String())
+			}
+		}
+	}
+
+	fmt.Fprintf(ui.out, "\033[%d;1H\033[7m", rows-1)
+	fmt.Fprintf(ui.out, "%-*s", cols, "cfilter --interactive: j/k scroll, space/b page, g/G top/bottom, 1-9 toggle rule, n/N next/prev match, / search, w dump, q quit")
+	fmt.Fprint(ui.out, "\033[0m")
+
+	fmt.Fprintf(ui.out, "\033[%d;1H\033[K%s", rows, ui.status)
+	ui.out.Flush()
+}
+
+// winsize mirrors struct winsize from <sys/ioctl.h>, used with TIOCGWINSZ
+// to size the viewer's screen.
+type winsize struct {
+	Row, Col, Xpixel, Ypixel uint16
+}
+
+// termSize reports fd's terminal size, falling back to a conservative
+// default if it cannot be determined.
+func termSize(fd uintptr) (rows, cols int) {
+	var ws winsize
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws)))
+	if errno != 0 || ws.Row == 0 {
+		return 24, 80
+	}
+	return int(ws.Row), int(ws.Col)
+}
+
+// ioctlTermios wraps the TCGETS/TCSETS ioctl, which the standard syscall
+// package exposes the Termios type for but not, on this platform, a helper
+// to call it with.
+func ioctlTermios(fd uintptr, req uintptr, term *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(term)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// enableRawMode puts fd into raw mode (no echo, no line buffering, no
+// signal-generating keys) for the interactive viewer's single-key
+// bindings, returning the previous state to restore on exit.
+func enableRawMode(fd uintptr) (*syscall.Termios, error) {
+	var saved syscall.Termios
+	if err := ioctlTermios(fd, syscall.TCGETS, &saved); err != nil {
+		return nil, err
+	}
+
+	raw := saved
+	raw.Lflag &^= syscall.ECHO | syscall.ICANON | syscall.ISIG
+	raw.Iflag &^= syscall.IXON
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+
+	if err := ioctlTermios(fd, syscall.TCSETS, &raw); err != nil {
+		return nil, err
+	}
+	return &saved, nil
+}
+
+func restoreMode(fd uintptr, saved *syscall.Termios) {
+	if saved != nil {
+		ioctlTermios(fd, syscall.TCSETS, saved)
+	}
+}